@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var apiToken = flag.String("api-token", "", "bearer token required on /api/rules; if unset, the API only accepts requests from loopback addresses")
+
+// ruleSetRequest is the JSON body accepted by POST/PUT /api/rules.
+type ruleSetRequest struct {
+	Name  string `json:"name"`
+	Rules []Rule `json:"rules"`
+}
+
+// registerRulesAPI wires up a REST API over store, so rule sets can be
+// managed programmatically alongside the cookie-based HTML form. Unlike
+// the per-session cookie rules, a rule set created here is scoped by host
+// and content-type and applies to every visitor, so the endpoint is
+// gated by authorizedForAPI before any handler code runs.
+func registerRulesAPI(store *RuleStore) {
+	http.HandleFunc("/api/rules", func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedForAPI(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			if name := r.URL.Query().Get("name"); name != "" {
+				writeJSON(w, store.Get(name))
+				return
+			}
+			writeJSON(w, store.All())
+
+		case http.MethodPost, http.MethodPut:
+			var req ruleSetRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Name == "" {
+				http.Error(w, "name is required", http.StatusBadRequest)
+				return
+			}
+			if err := store.Put(req.Name, req.Rules); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, req.Rules)
+
+		case http.MethodDelete:
+			name := r.URL.Query().Get("name")
+			if name == "" {
+				http.Error(w, "name is required", http.StatusBadRequest)
+				return
+			}
+			if err := store.Delete(name); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// authorizedForAPI reports whether r may use /api/rules. With -api-token
+// set, it requires a matching "Authorization: Bearer <token>" header;
+// otherwise, since the rule sets managed here apply to every visitor
+// rather than just the caller's own session, it falls back to only
+// trusting requests from loopback addresses.
+func authorizedForAPI(r *http.Request) bool {
+	if *apiToken != "" {
+		const prefix = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, prefix) {
+			return false
+		}
+		token := auth[len(prefix):]
+		return subtle.ConstantTimeCompare([]byte(token), []byte(*apiToken)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host).IsLoopback()
+}
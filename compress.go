@@ -0,0 +1,41 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decodedBody wraps a decompressing reader together with the underlying
+// response body, so closing it closes both.
+type decodedBody struct {
+	io.Reader
+	underlying io.Closer
+}
+
+func (b decodedBody) Close() error {
+	return b.underlying.Close()
+}
+
+// decompressBody wraps body in a reader that undoes the given
+// Content-Encoding, so the rest of the pipeline always sees decoded bytes
+// no matter what encoding the upstream chose to send. An empty or
+// "identity" encoding is returned unchanged.
+func decompressBody(body io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return decodedBody{Reader: zr, underlying: body}, nil
+	case "br":
+		return decodedBody{Reader: brotli.NewReader(body), underlying: body}, nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+}
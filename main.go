@@ -1,40 +1,76 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
-	"fmt"
 	"html/template"
-	"io/ioutil"
+	"io"
 	"log"
 	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
-	"path"
 	"regexp"
 	"strings"
+	"time"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
 
-	"github.com/PuerkitoBio/goquery"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var bind = flag.String("bind", ":8080", "the address to bind to")
+var rulesFile = flag.String("rules-file", "rules.json", "path to the server-side rule store")
 var templates = template.Must(template.ParseGlob("templates/*"))
 
 func main() {
+	flag.Parse()
+
+	store, err := NewRuleStore(*rulesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registerRulesAPI(store)
+	http.Handle("/metrics", promhttp.Handler())
+
+	limiter := newRateLimiterSet(*rateLimit, *rateBurst)
+	client := newUpstreamClient()
+
 	http.HandleFunc("/view/", func(w http.ResponseWriter, r *http.Request) {
-		parts := strings.Split(r.URL.Path, "/")
+		clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if !limiter.Allow(clientIP) {
+			log.Printf("Rejected fetch from %s: reason=rate-limited", clientIP)
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
 
-		urlPrefix := strings.Join(parts[:4], "/") + "/"
+		depth := redirectDepth(r)
+		if depth > maxRedirects {
+			http.Error(w, "too many redirects", http.StatusLoopDetected)
+			return
+		}
+
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) < 4 {
+			http.Error(w, "malformed /view/ path, expected /view/<scheme>/<host>/<path>", http.StatusBadRequest)
+			return
+		}
 
 		var newURL url.URL
 		newURL.Scheme = parts[2]
 		newURL.Host = parts[3]
 		newURL.Path = "/" + strings.Join(parts[4:], "/")
-		newURL.RawQuery = r.URL.RawQuery
+		newURL.RawQuery = stripRedirectDepth(r)
+
+		if ok, reason := hostAllowed(newURL.Host); !ok {
+			log.Printf("Rejected fetch to %s: reason=%s", newURL.Host, reason)
+			http.Error(w, "host not allowed", http.StatusForbidden)
+			return
+		}
 
 		log.Printf("Proxying %q", newURL.String())
 
@@ -42,80 +78,98 @@ func main() {
 		r.Header.Set("Host", newURL.Host)
 		r.URL = &newURL
 		r.RequestURI = ""
-		r.Header.Del("Accept-Encoding")
-		resp, err := http.DefaultClient.Do(r)
+
+		var reused bool
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+		}
+		r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+
+		start := time.Now()
+		resp, err := client.Do(r)
+		recordUpstream(statusOrZero(resp), time.Since(start), reused)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
-
 		defer resp.Body.Close()
-		buf, err := ioutil.ReadAll(resp.Body)
+
+		base := newURL
+
+		resp.Header.Del("Content-Security-Policy")
+		resp.Header.Set("X-Resolved-Url", base.String())
+
+		if isRedirectStatus(resp.StatusCode) {
+			if loc := resp.Header.Get("Location"); loc != "" {
+				resp.Header.Set("Location", rewriteLocation(loc, &base, depth+1))
+			}
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+
+		contentEncoding := resp.Header.Get("Content-Encoding")
+		wasEncoded := contentEncoding != "" && contentEncoding != "identity"
+		decoded, err := decompressBody(resp.Body, contentEncoding)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
 
-		contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		br := bufio.NewReader(io.LimitReader(decoded, *maxBodySize))
+		contentTypeHeader := resp.Header.Get("Content-Type")
+		contentType, _, err := mime.ParseMediaType(contentTypeHeader)
 		if err != nil {
-			contentType = http.DetectContentType(buf)
+			peek, _ := br.Peek(512)
+			contentType = http.DetectContentType(peek)
 		}
 
 		log.Printf("Content-Type: %s", contentType)
 
-		if contentType == "text/html" {
-			rules := getRules(r)
-
-			var regexps []*regexp.Regexp
-			for _, rule := range rules {
-				r, err := regexp.Compile(rule.Match)
-				if err != nil {
-					log.Println(err)
-				}
-				regexps = append(regexps, r)
-			}
-
-			doc, err := goquery.NewDocumentFromReader(bytes.NewReader(buf))
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-
-			doc.Find("a, link").Each(func(_ int, s *goquery.Selection) {
-				rewriteAttr(s, "href", urlPrefix)
-			})
-			doc.Find("img, script").Each(func(_ int, s *goquery.Selection) {
-				rewriteAttr(s, "src", urlPrefix)
-			})
-			doc.Find("form").Each(func(_ int, s *goquery.Selection) {
-				rewriteAttr(s, "action", urlPrefix)
-			})
-
-			for _, n := range doc.Selection.Nodes {
-				Walk(n, func(n *html.Node) {
-					if n.Type == html.TextNode {
-						for i, r := range regexps {
-							n.Data = r.ReplaceAllString(n.Data, rules[i].Replace)
-						}
-					}
-				})
+		rules := append(store.ForRequest(base.Host, contentType), getRules(r)...)
+		cr := compileRules(rules)
+		for k, vs := range resp.Header {
+			for i, v := range vs {
+				resp.Header[k][i] = applyRules(cr.headers, v)
 			}
+		}
 
-			body, err := goquery.OuterHtml(doc.Selection)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
+		if contentType != "text/html" {
+			for k, v := range resp.Header {
+				w.Header()[k] = v
 			}
-			buf = []byte(body)
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, br)
+			return
 		}
 
-		resp.Header.Del("Content-Security-Policy")
+		body, err := charset.NewReader(br, contentTypeHeader)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
 
 		for k, v := range resp.Header {
 			w.Header()[k] = v
 		}
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(resp.StatusCode)
-		w.Write(buf)
+
+		if needsBufferedRewrite(resp.ContentLength, wasEncoded, rules) {
+			if err := rewriteBufferedHTML(w, body, &base, cr); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		if err := newStreamRewriter(w, body, &base, cr).Run(); err != nil {
+			log.Println(err)
+		}
 	})
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		rules := getRules(r)
@@ -129,7 +183,7 @@ func main() {
 				return
 			}
 
-			rules = append(rules, Rule{match, replace})
+			rules = append(rules, Rule{Match: match, Replace: replace})
 
 			cookieBody, _ := json.Marshal(rules)
 			http.SetCookie(w, &http.Cookie{
@@ -169,32 +223,3 @@ func getRules(r *http.Request) []Rule {
 	}
 	return rules
 }
-
-// Rule represents a single match replace rule.
-type Rule struct {
-	Match, Replace string
-}
-
-func rewriteAttr(s *goquery.Selection, attr, urlPrefix string) {
-	href := s.AttrOr(attr, "")
-	if strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") || strings.HasPrefix(href, "//") {
-		parsed, err := url.Parse(href)
-		if len(parsed.Scheme) == 0 {
-			parsed.Scheme = "https"
-		}
-		if err == nil {
-			href = fmt.Sprintf("/view/%s/%s%s", parsed.Scheme, parsed.Host, parsed.Path)
-			if len(parsed.RawQuery) > 0 {
-				href += "?" + parsed.RawQuery
-			}
-			if len(parsed.Fragment) > 0 {
-				href += "#" + parsed.Fragment
-			}
-		}
-	} else if strings.HasPrefix(href, "/") {
-		href = path.Join(urlPrefix, href)
-	}
-	if len(href) > 0 {
-		s.SetAttr(attr, href)
-	}
-}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// None of these metrics are labeled by upstream host: the host comes
+// straight from the attacker-controlled /view/<scheme>/<host>/... path,
+// and without -allow-hosts configured a client can generate unbounded
+// distinct values at the permitted rate-limit, which the Prometheus
+// client would keep in memory forever.
+var upstreamLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "proxy_upstream_fetch_seconds",
+	Help:    "Time spent fetching a page from the upstream host.",
+	Buckets: prometheus.DefBuckets,
+})
+
+var upstreamStatus = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_upstream_responses_total",
+	Help: "Upstream responses by status code.",
+}, []string{"code"})
+
+// upstreamConnReused tracks, as a proxy for a "cache hit ratio": this
+// proxy has no response cache of its own, so the closest useful signal is
+// how often an upstream fetch reuses a pooled connection from
+// newUpstreamClient's transport instead of paying a fresh handshake.
+var upstreamConnReused = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_upstream_connections_total",
+	Help: "Upstream connections by whether they were reused from the pool.",
+}, []string{"reused"})
+
+// recordUpstream records the outcome of a single upstream fetch for the
+// /metrics endpoint.
+func recordUpstream(status int, dur time.Duration, reused bool) {
+	upstreamLatency.Observe(dur.Seconds())
+	upstreamStatus.WithLabelValues(statusLabel(status)).Inc()
+	upstreamConnReused.WithLabelValues(reusedLabel(reused)).Inc()
+}
+
+// statusOrZero returns resp's status code, or 0 if the fetch failed before
+// a response was received, so recordUpstream can be called unconditionally.
+func statusOrZero(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+func statusLabel(status int) string {
+	if status == 0 {
+		return "error"
+	}
+	return strconv.Itoa(status)
+}
+
+func reusedLabel(reused bool) string {
+	if reused {
+		return "true"
+	}
+	return "false"
+}
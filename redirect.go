@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// redirectDepthParam is a query parameter the proxy adds to a rewritten
+// Location so that, as the browser follows a chain of redirects back
+// through /view/, each hop can tell how deep it is without needing any
+// server-side state.
+const redirectDepthParam = "_rd"
+
+// maxRedirects bounds how many hops of a redirect chain the proxy will
+// rewrite and forward before giving up, matching the default depth of
+// Go's own http.Client redirect following.
+const maxRedirects = 10
+
+// isRedirectStatus reports whether code is one of the 3xx statuses that
+// carry a Location header the proxy needs to rewrite.
+func isRedirectStatus(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+// redirectDepth returns the value of redirectDepthParam on r, or 0 if it's
+// absent or invalid.
+func redirectDepth(r *http.Request) int {
+	depth, err := strconv.Atoi(r.URL.Query().Get(redirectDepthParam))
+	if err != nil || depth < 0 {
+		return 0
+	}
+	return depth
+}
+
+// stripRedirectDepth removes redirectDepthParam from r's query before it's
+// forwarded upstream as part of the proxied request, leaving the rest of
+// the query string untouched.
+func stripRedirectDepth(r *http.Request) string {
+	if r.URL.Query().Get(redirectDepthParam) == "" {
+		return r.URL.RawQuery
+	}
+	q := r.URL.Query()
+	q.Del(redirectDepthParam)
+	return q.Encode()
+}
+
+// rewriteLocation resolves location against base and re-encodes it as a
+// /view/... proxy URL carrying the next redirect depth, so the browser's
+// next hop stays inside the proxy and the handler can detect a loop.
+func rewriteLocation(location string, base *url.URL, depth int) string {
+	rewritten := rewriteURL(location, base)
+	u, err := url.Parse(rewritten)
+	if err != nil {
+		return rewritten
+	}
+	q := u.Query()
+	q.Set(redirectDepthParam, strconv.Itoa(depth))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
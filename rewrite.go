@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// urlAttrs maps element tag names to the attributes on them that carry a
+// URL, per the W3C HTML list of URL-bearing attributes.
+var urlAttrs = map[string][]string{
+	"a":          {"href"},
+	"applet":     {"codebase"},
+	"area":       {"href"},
+	"audio":      {"src"},
+	"base":       {"href"},
+	"blockquote": {"cite"},
+	"body":       {"background"},
+	"button":     {"formaction"},
+	"del":        {"cite"},
+	"embed":      {"src"},
+	"form":       {"action"},
+	"frame":      {"longdesc", "src"},
+	"head":       {"profile"},
+	"html":       {"manifest"},
+	"iframe":     {"longdesc", "src"},
+	"img":        {"longdesc", "src", "usemap"},
+	"input":      {"src", "usemap", "formaction"},
+	"ins":        {"cite"},
+	"link":       {"href"},
+	"object":     {"classid", "codebase", "data", "usemap"},
+	"q":          {"cite"},
+	"script":     {"src"},
+	"source":     {"src"},
+	"video":      {"poster", "src"},
+}
+
+// srcsetAttrs are attributes whose value is a comma-separated list of
+// "<url> <descriptor>" candidates rather than a single URL.
+var srcsetAttrs = map[string][]string{
+	"img":    {"srcset"},
+	"source": {"srcset"},
+}
+
+// cssURLRe matches a CSS url(...) reference. Go's RE2-based regexp engine
+// has no backreferences, so instead of `(['"]?)...\1` to require the
+// closing quote match the opening one, this lists one alternative per
+// quote style plus an unquoted fallback.
+var cssURLRe = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^'")]+))\s*\)`)
+
+// metaRefreshRe splits a <meta http-equiv="refresh" content="..."> value
+// into the delay, the URL (optionally quoted), and the URL itself, so the
+// URL portion can be rewritten without disturbing the delay.
+var metaRefreshRe = regexp.MustCompile(`(?i)^(\s*[0-9]+\s*;\s*url\s*=\s*)(['"]?)([^'"]*)['"]?\s*$`)
+
+// rewriteBufferedHTML reads the whole of body, parses it with goquery, and
+// rewrites it in one shot. It's used as a fallback for small responses and
+// for rules that need more context than a single text token provides.
+func rewriteBufferedHTML(w io.Writer, body io.Reader, base *url.URL, cr compiledRules) error {
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+
+	for _, n := range doc.Selection.Nodes {
+		rewriteTree(n, base, cr)
+	}
+
+	out, err := goquery.OuterHtml(doc.Selection)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, out)
+	return err
+}
+
+// rewriteTree walks every node in the tree rooted at n once, rewriting all
+// URL-bearing attributes, srcset candidate lists, and url(...) references
+// found in <style> text and style attributes, running text rules over text
+// nodes and attrs rules over every attribute value along the way. base is
+// the URL that relative references resolve against, and is updated in
+// place if a <base href> tag is encountered.
+func rewriteTree(n *html.Node, base *url.URL, cr compiledRules) {
+	cur := base
+	Walk(n, func(n *html.Node) {
+		if n.Type == html.TextNode {
+			n.Data = applyRules(cr.text, n.Data)
+			return
+		}
+		if n.Type != html.ElementNode {
+			return
+		}
+		if n.Data == "base" {
+			cur = resolveBase(n.Attr, cur)
+		}
+		n.Attr = rewriteElementAttrs(n.Data, n.Attr, cur)
+		if len(cr.attrs) > 0 {
+			n.Attr = applyAttrRules(n.Attr, cr.attrs)
+		}
+		if n.Data == "style" && n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
+			n.FirstChild.Data = rewriteCSSURLs(n.FirstChild.Data, cur)
+		}
+	})
+}
+
+// applyAttrRules runs crs against every attribute value in attrs.
+func applyAttrRules(attrs []html.Attribute, crs []compiledRule) []html.Attribute {
+	for i, a := range attrs {
+		attrs[i].Val = applyRules(crs, a.Val)
+	}
+	return attrs
+}
+
+// resolveBase resolves the href of a <base> tag against the current base,
+// returning the current base unchanged if the tag has no href or it fails
+// to parse.
+func resolveBase(attrs []html.Attribute, base *url.URL) *url.URL {
+	href := getAttr(attrs, "href")
+	if href == "" {
+		return base
+	}
+	u, err := url.Parse(href)
+	if err != nil {
+		return base
+	}
+	return base.ResolveReference(u)
+}
+
+// rewriteElementAttrs rewrites the URL-bearing attributes, srcset candidate
+// lists, and inline style of a single element's attribute list, so that the
+// same logic can run over a *html.Node tree or a stream of html.Token.
+func rewriteElementAttrs(tag string, attrs []html.Attribute, base *url.URL) []html.Attribute {
+	for _, attr := range urlAttrs[tag] {
+		attrs = rewriteURLAttr(attrs, attr, base)
+	}
+	for _, attr := range srcsetAttrs[tag] {
+		attrs = rewriteSrcsetAttr(attrs, attr, base)
+	}
+	if style := getAttr(attrs, "style"); style != "" {
+		attrs = setAttr(attrs, "style", rewriteCSSURLs(style, base))
+	}
+	if tag == "meta" {
+		attrs = rewriteMetaRefresh(attrs, base)
+	}
+	return attrs
+}
+
+// rewriteMetaRefresh rewrites the URL embedded in a
+// <meta http-equiv="refresh" content="0; url=..."> tag, which is a hidden
+// navigation the browser would otherwise follow straight to the upstream
+// site, bypassing the proxy the same way an unrewritten Location header
+// would.
+func rewriteMetaRefresh(attrs []html.Attribute, base *url.URL) []html.Attribute {
+	if !strings.EqualFold(getAttr(attrs, "http-equiv"), "refresh") {
+		return attrs
+	}
+	content := getAttr(attrs, "content")
+	m := metaRefreshRe.FindStringSubmatch(content)
+	if m == nil {
+		return attrs
+	}
+	prefix, quote, href := m[1], m[2], m[3]
+	return setAttr(attrs, "content", prefix+quote+rewriteURL(href, base)+quote)
+}
+
+func getAttr(attrs []html.Attribute, key string) string {
+	for _, a := range attrs {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setAttr(attrs []html.Attribute, key, val string) []html.Attribute {
+	for i, a := range attrs {
+		if a.Key == key {
+			attrs[i].Val = val
+			return attrs
+		}
+	}
+	return append(attrs, html.Attribute{Key: key, Val: val})
+}
+
+func rewriteURLAttr(attrs []html.Attribute, attr string, base *url.URL) []html.Attribute {
+	val := getAttr(attrs, attr)
+	if val == "" {
+		return attrs
+	}
+	return setAttr(attrs, attr, rewriteURL(val, base))
+}
+
+// rewriteSrcsetAttr rewrites each URL candidate in a srcset attribute,
+// preserving any width/density descriptor that follows it.
+func rewriteSrcsetAttr(attrs []html.Attribute, attr string, base *url.URL) []html.Attribute {
+	val := getAttr(attrs, attr)
+	if val == "" {
+		return attrs
+	}
+	candidates := strings.Split(val, ",")
+	for i, c := range candidates {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		parts := strings.SplitN(c, " ", 2)
+		rewritten := rewriteURL(parts[0], base)
+		if len(parts) == 2 {
+			candidates[i] = rewritten + " " + parts[1]
+		} else {
+			candidates[i] = rewritten
+		}
+	}
+	return setAttr(attrs, attr, strings.Join(candidates, ", "))
+}
+
+// rewriteCSSURLs rewrites every url(...) reference found in a CSS blob,
+// such as a <style> block or an inline style attribute.
+func rewriteCSSURLs(css string, base *url.URL) string {
+	return cssURLRe.ReplaceAllStringFunc(css, func(m string) string {
+		idx := cssURLRe.FindStringSubmatchIndex(m)
+		switch {
+		case idx[2] >= 0: // double-quoted: "..."
+			return `url("` + rewriteURL(m[idx[2]:idx[3]], base) + `")`
+		case idx[4] >= 0: // single-quoted: '...'
+			return "url('" + rewriteURL(m[idx[4]:idx[5]], base) + "')"
+		default: // unquoted
+			return "url(" + rewriteURL(strings.TrimSpace(m[idx[6]:idx[7]]), base) + ")"
+		}
+	})
+}
+
+// rewriteURL resolves href against base - handling absolute, protocol-
+// relative, root-relative, and plain relative URLs alike - and re-encodes
+// the result as a /view/<scheme>/<host>/<path> proxy URL.
+func rewriteURL(href string, base *url.URL) string {
+	u, err := url.Parse(href)
+	if err != nil {
+		return href
+	}
+	// Opaque URIs (mailto:, tel:, javascript:, data:, ...) have no
+	// host/path to resolve - ResolveReference would otherwise turn them
+	// into a bogus /view/<scheme>/ with the address lost. Leave any
+	// scheme other than plain http(s) - including these - untouched, the
+	// same as the attribute/text rewriter did before this request.
+	if u.Opaque != "" || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") {
+		return href
+	}
+	resolved := base.ResolveReference(u)
+	if len(resolved.Scheme) == 0 {
+		resolved.Scheme = "https"
+	}
+	p := fmt.Sprintf("/view/%s/%s%s", resolved.Scheme, resolved.Host, resolved.Path)
+	if len(resolved.RawQuery) > 0 {
+		p += "?" + resolved.RawQuery
+	}
+	if len(resolved.Fragment) > 0 {
+		p += "#" + resolved.Fragment
+	}
+	return p
+}
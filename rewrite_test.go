@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestRewriteURL(t *testing.T) {
+	base, err := url.Parse("https://example.com/a/b/page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		href string
+		want string
+	}{
+		{"absolute", "https://other.example/x", "/view/https/other.example/x"},
+		{"protocol-relative", "//other.example/x", "/view/https/other.example/x"},
+		{"root-relative", "/c/d", "/view/https/example.com/c/d"},
+		{"relative", "c.html", "/view/https/example.com/a/b/c.html"},
+		{"parent-relative", "../c.html", "/view/https/example.com/a/c.html"},
+		{"query-only", "?q=1", "/view/https/example.com/a/b/page.html?q=1"},
+		{"fragment-only", "#section", "/view/https/example.com/a/b/page.html#section"},
+		{"query-and-fragment", "c.html?q=1#top", "/view/https/example.com/a/b/c.html?q=1#top"},
+		{"mailto", "mailto:foo@bar.com", "mailto:foo@bar.com"},
+		{"data-uri", "data:image/png;base64,AAAA", "data:image/png;base64,AAAA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteURL(tt.href, base); got != tt.want {
+				t.Errorf("rewriteURL(%q, %q) = %q, want %q", tt.href, base, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRewriteURLNonRootPage covers a response served from a non-root
+// upstream path, where "../" and bare filenames must resolve against the
+// page's own directory rather than the host root.
+func TestRewriteURLNonRootPage(t *testing.T) {
+	base, err := url.Parse("https://example.com/blog/2020/post/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		href string
+		want string
+	}{
+		{"img.png", "/view/https/example.com/blog/2020/post/img.png"},
+		{"../other/index.html", "/view/https/example.com/blog/2020/other/index.html"},
+		{"/top-level", "/view/https/example.com/top-level"},
+	}
+	for _, tt := range tests {
+		if got := rewriteURL(tt.href, base); got != tt.want {
+			t.Errorf("rewriteURL(%q, %q) = %q, want %q", tt.href, base, got, tt.want)
+		}
+	}
+}
+
+func TestResolveBase(t *testing.T) {
+	base, err := url.Parse("https://example.com/a/b/page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := resolveBase([]html.Attribute{{Key: "href", Val: "/new-base/"}}, base)
+	if got.String() != "https://example.com/new-base/" {
+		t.Errorf("resolveBase = %q, want %q", got.String(), "https://example.com/new-base/")
+	}
+
+	// No href: base is returned unchanged.
+	if got := resolveBase(nil, base); got != base {
+		t.Errorf("resolveBase(nil, base) = %v, want unchanged base", got)
+	}
+}
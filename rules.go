@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Scope controls which part of a proxied response a Rule is applied to.
+type Scope string
+
+const (
+	// ScopeText applies a rule's regex to the text content of the page,
+	// this is the default and matches the original cookie-based behavior.
+	ScopeText Scope = "text"
+	// ScopeAttrs applies a rule's regex to every HTML attribute value.
+	ScopeAttrs Scope = "attrs"
+	// ScopeHeaders applies a rule's regex to every response header value.
+	ScopeHeaders Scope = "headers"
+)
+
+// Rule represents a single match/replace rule, optionally restricted to a
+// host and content-type so that server-side rule sets can be scoped to the
+// pages they're meant for instead of running against everything proxied.
+type Rule struct {
+	Name        string `json:"name,omitempty"`
+	Match       string `json:"match"`
+	Replace     string `json:"replace"`
+	Host        string `json:"host,omitempty"`        // glob, e.g. "*.example.com"
+	ContentType string `json:"contentType,omitempty"` // e.g. "text/html"
+	Scope       Scope  `json:"scope,omitempty"`
+	Order       int    `json:"order,omitempty"`
+}
+
+// Applies reports whether the rule's host glob and content-type filter
+// match the given response.
+func (rule Rule) Applies(host, contentType string) bool {
+	if rule.Host != "" {
+		if ok, _ := path.Match(rule.Host, host); !ok {
+			return false
+		}
+	}
+	if rule.ContentType != "" && !strings.HasPrefix(contentType, rule.ContentType) {
+		return false
+	}
+	return true
+}
+
+// compiledRule pairs a Rule with its compiled regex, ready to run against a
+// single response.
+type compiledRule struct {
+	rule Rule
+	re   *regexp.Regexp
+}
+
+// compiledRules buckets a response's applicable rules by scope, so the
+// HTML rewriter and header rewriter each only see the rules meant for them.
+type compiledRules struct {
+	text    []compiledRule
+	attrs   []compiledRule
+	headers []compiledRule
+}
+
+// compileRules compiles every rule's regex and sorts them into the bucket
+// matching their Scope. Rules with an invalid regex are logged and
+// skipped, matching the existing cookie-rule behavior.
+func compileRules(rules []Rule) compiledRules {
+	var cr compiledRules
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		c := compiledRule{rule: rule, re: re}
+		switch rule.Scope {
+		case ScopeAttrs:
+			cr.attrs = append(cr.attrs, c)
+		case ScopeHeaders:
+			cr.headers = append(cr.headers, c)
+		default:
+			cr.text = append(cr.text, c)
+		}
+	}
+	return cr
+}
+
+// applyRules runs every rule in crs, in order, against s and returns the
+// result.
+func applyRules(crs []compiledRule, s string) string {
+	for _, c := range crs {
+		s = c.re.ReplaceAllString(s, c.rule.Replace)
+	}
+	return s
+}
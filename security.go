@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var allowHosts = flag.String("allow-hosts", "", "comma-separated glob patterns of hosts that may be proxied; if set, only matching hosts are allowed")
+var denyHosts = flag.String("deny-hosts", "", "comma-separated glob patterns of hosts that may never be proxied, in addition to the built-in private-network deny list")
+var maxBodySize = flag.Int64("max-body-size", 32<<20, "maximum upstream response body size, in bytes")
+var rateLimit = flag.Float64("rate-limit", 5, "maximum requests per second allowed per client IP")
+var rateBurst = flag.Int("rate-burst", 10, "burst size allowed per client IP on top of -rate-limit")
+
+// defaultDenyCIDRs is checked against the resolved IP of every upstream
+// fetch, independent of -deny-hosts, to close off the classic SSRF
+// targets: loopback, RFC1918 private ranges, link-local, and IPv6 ULA
+// addresses (which cover the cloud metadata endpoint at 169.254.169.254).
+var defaultDenyCIDRs = mustParseCIDRs(
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// hostAllowed reports whether host may be fetched at all, based on
+// -allow-hosts and -deny-hosts. It returns a short reason code for
+// rejected hosts suitable for logging; it does not check the host's
+// resolved IP, guardedDialContext does that at dial time.
+func hostAllowed(host string) (ok bool, reason string) {
+	for _, pattern := range splitGlobs(*denyHosts) {
+		if m, _ := path.Match(pattern, host); m {
+			return false, "deny-hosts"
+		}
+	}
+	allow := splitGlobs(*allowHosts)
+	if len(allow) == 0 {
+		return true, ""
+	}
+	for _, pattern := range allow {
+		if m, _ := path.Match(pattern, host); m {
+			return true, ""
+		}
+	}
+	return false, "not-in-allow-hosts"
+}
+
+func splitGlobs(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// guardedDialContext resolves addr and refuses to dial it if any of its
+// resolved IPs fall in defaultDenyCIDRs, so a client can't reach internal
+// services or the cloud metadata endpoint by proxying through us.
+func guardedDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	ip, port, err := guardedResolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
+
+// guardedResolve resolves addr and returns its first IP and port, refusing
+// to resolve it at all if any returned IP falls in defaultDenyCIDRs. It's
+// the transport-agnostic core of guardedDialContext, shared with the
+// HTTP/3 QUIC dialer in transport.go, which can't use a net.Dialer.
+func guardedResolve(ctx context.Context, addr string) (net.IP, string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, "", err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, ip := range ips {
+		if ipDenied(ip.IP) {
+			log.Printf("Rejected fetch to %s: reason=private-ip ip=%s", addr, ip.IP)
+			return nil, "", fmt.Errorf("refusing to dial private address %s", ip.IP)
+		}
+	}
+	return ips[0].IP, port, nil
+}
+
+func ipDenied(ip net.IP) bool {
+	for _, n := range defaultDenyCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiterSet is a simple per-key token bucket, used to cap how many
+// upstream fetches a single client IP can make per second.
+type rateLimiterSet struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	rate    float64
+	burst   float64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiterSet(rate float64, burst int) *rateLimiterSet {
+	return &rateLimiterSet{
+		buckets: map[string]*tokenBucket{},
+		rate:    rate,
+		burst:   float64(burst),
+	}
+}
+
+// Allow reports whether key (typically a client IP) has a token available,
+// consuming one if so.
+func (s *rateLimiterSet) Allow(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: s.burst, last: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * s.rate
+	if b.tokens > s.burst {
+		b.tokens = s.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
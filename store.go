@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// RuleStore persists named, server-side rule sets to a JSON file on disk.
+// It's the server-side counterpart to the per-session cookie rules: rule
+// sets here apply to every client based on the host and content-type of
+// the page being proxied, instead of being scoped to one browser's cookie.
+type RuleStore struct {
+	mu   sync.RWMutex
+	path string
+	sets map[string][]Rule
+}
+
+// NewRuleStore loads the rule sets stored at path, if any, and returns a
+// store ready for concurrent use. A missing file is not an error; the
+// store starts out empty and path is created on the first save.
+func NewRuleStore(path string) (*RuleStore, error) {
+	s := &RuleStore{path: path, sets: map[string][]Rule{}}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &s.sets); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Names returns the name of every stored rule set.
+func (s *RuleStore) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.sets))
+	for name := range s.sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the rules in the named set, or nil if it doesn't exist.
+func (s *RuleStore) Get(name string) []Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sets[name]
+}
+
+// All returns every stored rule set, keyed by name.
+func (s *RuleStore) All() map[string][]Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	all := make(map[string][]Rule, len(s.sets))
+	for name, rules := range s.sets {
+		all[name] = rules
+	}
+	return all
+}
+
+// Put creates or replaces the named rule set and persists the store.
+func (s *RuleStore) Put(name string, rules []Rule) error {
+	s.mu.Lock()
+	s.sets[name] = rules
+	s.mu.Unlock()
+	return s.save()
+}
+
+// Delete removes the named rule set and persists the store. It's a no-op
+// if the set doesn't exist.
+func (s *RuleStore) Delete(name string) error {
+	s.mu.Lock()
+	_, ok := s.sets[name]
+	delete(s.sets, name)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no such rule set %q", name)
+	}
+	return s.save()
+}
+
+// ForRequest returns every rule, across every stored set, whose host glob
+// and content-type filter match the given response, sorted by Order.
+func (s *RuleStore) ForRequest(host, contentType string) []Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var names []string
+	for name := range s.sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var matched []Rule
+	for _, name := range names {
+		for _, rule := range s.sets[name] {
+			if rule.Applies(host, contentType) {
+				matched = append(matched, rule)
+			}
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].Order < matched[j].Order })
+	return matched
+}
+
+func (s *RuleStore) save() error {
+	s.mu.RLock()
+	buf, err := json.MarshalIndent(s.sets, "", "  ")
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, buf, 0644)
+}
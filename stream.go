@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// minBufferedSize is the response size, in bytes, below which streaming
+// isn't worth the added complexity and the buffered goquery path is used
+// instead.
+const minBufferedSize = 32 * 1024
+
+// needsBufferedRewrite reports whether a response should go through the
+// buffered goquery-based rewriter instead of the token-by-token streaming
+// rewriter: either the body is small enough that buffering costs nothing,
+// or one of the rules needs more context than a single text token, such as
+// a pattern that can match across tag boundaries. contentLength is only
+// trusted as a size hint when wasEncoded is false - the upstream's
+// Content-Length describes the wire (compressed) size, which by the time
+// this is called has already been decoded via decompressBody, so it can
+// be far smaller than the decoded body actually being rewritten.
+func needsBufferedRewrite(contentLength int64, wasEncoded bool, rules []Rule) bool {
+	if !wasEncoded && contentLength >= 0 && contentLength < minBufferedSize {
+		return true
+	}
+	for _, rule := range rules {
+		if strings.Contains(rule.Match, `\n`) || strings.Contains(rule.Match, "(?s") {
+			return true
+		}
+	}
+	return false
+}
+
+// streamRewriter rewrites an HTML document token by token as it is read
+// from r, writing the rewritten output to w as each token is produced so
+// that large pages never have to sit fully in memory.
+type streamRewriter struct {
+	w       io.Writer
+	z       *html.Tokenizer
+	base    *url.URL
+	cr      compiledRules
+	inStyle bool
+}
+
+// newStreamRewriter builds a streamRewriter reading tokens from r, already
+// decoded to UTF-8, and writing the rewritten HTML to w. base is the URL
+// that relative references in the document resolve against.
+func newStreamRewriter(w io.Writer, r io.Reader, base *url.URL, cr compiledRules) *streamRewriter {
+	return &streamRewriter{
+		w:    w,
+		z:    html.NewTokenizer(r),
+		base: base,
+		cr:   cr,
+	}
+}
+
+// Run consumes every token, rewriting URL attributes and, for text tokens,
+// running the user's regex rules, emitting each token as it's produced.
+func (s *streamRewriter) Run() error {
+	for {
+		tt := s.z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if err := s.z.Err(); err != io.EOF {
+				return err
+			}
+			return nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := s.z.Token()
+			if tok.Data == "base" {
+				s.base = resolveBase(tok.Attr, s.base)
+			}
+			tok.Attr = rewriteElementAttrs(tok.Data, tok.Attr, s.base)
+			if len(s.cr.attrs) > 0 {
+				tok.Attr = applyAttrRules(tok.Attr, s.cr.attrs)
+			}
+			if tt == html.StartTagToken && tok.Data == "style" {
+				s.inStyle = true
+			}
+			if _, err := io.WriteString(s.w, tok.String()); err != nil {
+				return err
+			}
+		case html.EndTagToken:
+			tok := s.z.Token()
+			if tok.Data == "style" {
+				s.inStyle = false
+			}
+			if _, err := io.WriteString(s.w, tok.String()); err != nil {
+				return err
+			}
+		case html.TextToken:
+			tok := s.z.Token()
+			if s.inStyle {
+				tok.Data = rewriteCSSURLs(tok.Data, s.base)
+			}
+			tok.Data = applyRules(s.cr.text, tok.Data)
+			if _, err := io.WriteString(s.w, tok.String()); err != nil {
+				return err
+			}
+		default:
+			if _, err := s.w.Write(s.z.Raw()); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+var h3 = flag.Bool("h3", false, "fetch upstream over HTTP/3 (QUIC) instead of HTTP/1.1 or HTTP/2")
+var maxIdleConnsPerHost = flag.Int("max-idle-conns-per-host", 16, "maximum idle upstream connections to keep open per host")
+var idleConnTimeout = flag.Duration("idle-conn-timeout", 90*time.Second, "how long an idle upstream connection is kept before closing")
+var dialTimeout = flag.Duration("dial-timeout", 10*time.Second, "timeout for establishing an upstream connection")
+
+// newUpstreamClient builds the *http.Client used to fetch proxied pages. It
+// pools connections per upstream host and attempts HTTP/2 so that repeat
+// fetches of the same site don't pay a fresh handshake every time, and
+// every dial still goes through guardedDialContext so the transport
+// tuning in this file can't reopen the SSRF hole closed in security.go.
+func newUpstreamClient() *http.Client {
+	client := &http.Client{
+		// The /view/ handler rewrites and hands 3xx responses back to the
+		// browser itself (see redirect.go) rather than following them
+		// here, so that the browser's address bar - and every subsequent
+		// request - stays inside the proxy. Returning ErrUseLastResponse
+		// on every redirect is what makes that interception possible;
+		// loop prevention for the chain of hops this produces is done via
+		// redirectDepthParam instead of the usual via-slice depth check.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if *h3 {
+		client.Transport = &http3.Transport{
+			TLSClientConfig: &tls.Config{},
+			Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+				ip, port, err := guardedResolve(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+				return quic.DialAddr(ctx, net.JoinHostPort(ip.String(), port), tlsCfg, cfg)
+			},
+		}
+		return client
+	}
+	client.Transport = &http.Transport{
+		DialContext:           guardedDialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   *maxIdleConnsPerHost,
+		IdleConnTimeout:       *idleConnTimeout,
+		TLSHandshakeTimeout:   *dialTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return client
+}